@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig controls the on-disk content cache.
+type CacheConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Dir          string `json:"dir"`
+	MaxSizeBytes int64  `json:"maxSizeBytes"`
+	// AllowPrivate caches responses marked Cache-Control: private/no-store
+	// or carrying Set-Cookie, which are skipped by default.
+	AllowPrivate bool `json:"allowPrivate"`
+}
+
+// cacheMeta is the on-disk representation of a cached response, minus
+// its body.
+type cacheMeta struct {
+	StatusLine string        `json:"statusLine"`
+	Headers    []HeaderField `json:"headers"`
+	StoredAt   int64         `json:"storedAt"` // unix seconds
+	BodySize   int64         `json:"bodySize"`
+}
+
+// Cache is a size-bounded, on-disk store of cacheable HTTP responses,
+// keyed by method + Host + request target and, once a Vary is known for
+// a URL, the values of the headers it names.
+type Cache struct {
+	dir          string
+	maxSizeBytes int64
+	allowPrivate bool
+
+	mu sync.Mutex
+}
+
+// NewCache creates the cache directory if needed and returns a Cache
+// backed by it.
+func NewCache(cfg *CacheConfig) (*Cache, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating cache dir: %w", err)
+	}
+	return &Cache{dir: cfg.Dir, maxSizeBytes: cfg.MaxSizeBytes, allowPrivate: cfg.AllowPrivate}, nil
+}
+
+// isCacheableRequest reports whether req is eligible to be served from
+// or stored into the cache.
+func isCacheableRequest(req *HTTPMessage) bool {
+	switch requestMethodOf(req) {
+	case "GET", "HEAD":
+	default:
+		return false
+	}
+	if _, ok := req.Headers.Get("Authorization"); ok {
+		return false
+	}
+	if cc, ok := req.Headers.Get("Cache-Control"); ok && strings.Contains(strings.ToLower(cc), "no-store") {
+		return false
+	}
+	return true
+}
+
+// isCacheableResponse reports whether resp may be stored: it must not be
+// a streaming response (chunk0-4's SSE/long-poll path never reaches a
+// point where buffering its body for caching would finish), must honor
+// Cache-Control: private/no-store and Set-Cookie unless the cache was
+// configured to ignore those, and must carry a freshness lifetime or a
+// validator — otherwise it could never be served from cache anyway, and
+// storing it is pure overhead.
+func (c *Cache) isCacheableResponse(resp *HTTPMessage) bool {
+	if isStreamingResponse(resp) {
+		return false
+	}
+	if !c.allowPrivate {
+		if cc, ok := resp.Headers.Get("Cache-Control"); ok {
+			lower := strings.ToLower(cc)
+			if strings.Contains(lower, "private") || strings.Contains(lower, "no-store") {
+				return false
+			}
+		}
+		if _, hasSetCookie := resp.Headers.Get("Set-Cookie"); hasSetCookie {
+			return false
+		}
+	}
+	if _, ok := freshnessLifetimeFromHeaders(resp.Headers, time.Now()); ok {
+		return true
+	}
+	_, _, hasValidator := validatorsFromHeaders(resp.Headers)
+	return hasValidator
+}
+
+// responseStatusCode parses the numeric status out of a response's
+// start-line, or 0 if it can't be parsed.
+func responseStatusCode(resp *HTTPMessage) int {
+	return statusCodeFromStartLine(resp.StartLine)
+}
+
+func requestMethodOf(req *HTTPMessage) string {
+	fields := strings.Fields(req.StartLine)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+func requestTargetOf(req *HTTPMessage) string {
+	fields := strings.Fields(req.StartLine)
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+// primaryKey identifies a URL regardless of Vary, so the cache can look
+// up which headers that URL's responses vary on before computing the
+// real entry key.
+func (c *Cache) primaryKey(req *HTTPMessage) string {
+	host, _ := req.Headers.Get("Host")
+	return hashParts(requestMethodOf(req), host, requestTargetOf(req))
+}
+
+// entryKey folds in the values of the headers named by varyNames, so
+// two requests that only differ in a Vary'd header get distinct entries.
+func (c *Cache) entryKey(req *HTTPMessage, varyNames []string) string {
+	host, _ := req.Headers.Get("Host")
+	parts := []string{requestMethodOf(req), host, requestTargetOf(req)}
+	sorted := append([]string(nil), varyNames...)
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		value, _ := req.Headers.Get(name)
+		parts = append(parts, name+"="+value)
+	}
+	return hashParts(parts...)
+}
+
+func hashParts(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) varyPath(primaryKey string) string {
+	return filepath.Join(c.dir, primaryKey+".vary.json")
+}
+func (c *Cache) metaPath(entryKey string) string { return filepath.Join(c.dir, entryKey+".meta.json") }
+func (c *Cache) bodyPath(entryKey string) string { return filepath.Join(c.dir, entryKey+".body") }
+
+func (c *Cache) readVaryNames(primaryKey string) []string {
+	data, err := os.ReadFile(c.varyPath(primaryKey))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil
+	}
+	return names
+}
+
+func (c *Cache) writeVaryNames(primaryKey string, names []string) error {
+	data, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.varyPath(primaryKey), data, 0o644)
+}
+
+// cachedEntry is an in-memory view of a stored response: its entry key,
+// its metadata, and its body.
+type cachedEntry struct {
+	key  string
+	meta cacheMeta
+	body []byte
+}
+
+// lookup returns the cached entry for req, if any is on disk.
+func (c *Cache) lookup(req *HTTPMessage) (*cachedEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	varyNames := c.readVaryNames(c.primaryKey(req))
+	key := c.entryKey(req, varyNames)
+
+	metaData, err := os.ReadFile(c.metaPath(key))
+	if err != nil {
+		return nil, false
+	}
+	var meta cacheMeta
+	if err := json.Unmarshal(metaData, &meta); err != nil {
+		return nil, false
+	}
+	body, err := os.ReadFile(c.bodyPath(key))
+	if err != nil {
+		return nil, false
+	}
+	return &cachedEntry{key: key, meta: meta, body: body}, true
+}
+
+// toResponse turns a cached entry back into an HTTPMessage ready to be
+// written to the client, with a freshly computed Age header.
+func (e *cachedEntry) toResponse() *HTTPMessage {
+	headers := NewHeaderList()
+	for _, f := range e.meta.Headers {
+		if strings.EqualFold(f.Name, "Age") {
+			continue
+		}
+		headers.Add(f.Name, f.Value)
+	}
+	age := time.Since(time.Unix(e.meta.StoredAt, 0))
+	headers.Set("Age", strconv.FormatInt(int64(age.Seconds()), 10))
+	return &HTTPMessage{
+		StartLine: e.meta.StatusLine,
+		Headers:   headers,
+		Body:      bytes.NewReader(e.body),
+	}
+}
+
+// isFresh reports whether e is still fresh per RFC 7234 section 4.2:
+// its age hasn't exceeded the freshness lifetime given by Cache-Control
+// max-age/s-maxage, or failing that, Expires minus Date.
+func (e *cachedEntry) isFresh() bool {
+	lifetime, ok := e.freshnessLifetime()
+	if !ok {
+		return false
+	}
+	age := time.Since(time.Unix(e.meta.StoredAt, 0))
+	return age < lifetime
+}
+
+func (e *cachedEntry) freshnessLifetime() (time.Duration, bool) {
+	headers := headerListFromFields(e.meta.Headers)
+	return freshnessLifetimeFromHeaders(headers, time.Unix(e.meta.StoredAt, 0))
+}
+
+// freshnessLifetimeFromHeaders computes a response's freshness lifetime
+// per RFC 7234 section 4.2 from Cache-Control max-age/s-maxage, or
+// failing that, Expires minus Date — falling back to fallbackDate (the
+// time the response was stored, or now for one not yet stored) when Date
+// is absent.
+func freshnessLifetimeFromHeaders(headers *HeaderList, fallbackDate time.Time) (time.Duration, bool) {
+	if cc, ok := headers.Get("Cache-Control"); ok {
+		if secs, ok := directiveSeconds(cc, "s-maxage"); ok {
+			return time.Duration(secs) * time.Second, true
+		}
+		if secs, ok := directiveSeconds(cc, "max-age"); ok {
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	if expiresStr, ok := headers.Get("Expires"); ok {
+		expires, err := http1123OrRFC850(expiresStr)
+		if err != nil {
+			return 0, false
+		}
+		dateStr, _ := headers.Get("Date")
+		date, err := http1123OrRFC850(dateStr)
+		if err != nil {
+			date = fallbackDate
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+func (e *cachedEntry) validators() (etag, lastModified string, ok bool) {
+	return validatorsFromHeaders(headerListFromFields(e.meta.Headers))
+}
+
+func validatorsFromHeaders(headers *HeaderList) (etag, lastModified string, ok bool) {
+	etag, hasETag := headers.Get("ETag")
+	lastModified, hasLastModified := headers.Get("Last-Modified")
+	return etag, lastModified, hasETag || hasLastModified
+}
+
+func headerListFromFields(fields []HeaderField) *HeaderList {
+	h := NewHeaderList()
+	for _, f := range fields {
+		h.Add(f.Name, f.Value)
+	}
+	return h
+}
+
+func directiveSeconds(cacheControl, directive string) (int64, bool) {
+	for _, part := range strings.Split(cacheControl, ",") {
+		part = strings.TrimSpace(part)
+		name, value, found := strings.Cut(part, "=")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), directive) {
+			continue
+		}
+		secs, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		return secs, true
+	}
+	return 0, false
+}
+
+func http1123OrRFC850(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC1123, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC850, value)
+}
+
+// addRevalidationHeaders injects If-None-Match / If-Modified-Since into
+// req based on e's stored validators.
+func (e *cachedEntry) addRevalidationHeaders(req *HTTPMessage) {
+	etag, lastModified, _ := e.validators()
+	if etag != "" {
+		req.Headers.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Headers.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// refreshFrom304 merges a 304's headers into the stored entry's
+// metadata (per RFC 7234 section 4.3.4) and re-stamps StoredAt, keeping
+// the existing body.
+func (c *Cache) refreshFrom304(entry *cachedEntry, notModified *HTTPMessage) error {
+	headers := headerListFromFields(entry.meta.Headers)
+	for _, f := range notModified.Headers.All() {
+		if strings.EqualFold(f.Name, "Content-Length") {
+			continue
+		}
+		headers.Set(f.Name, f.Value)
+	}
+	entry.meta.Headers = headers.All()
+	entry.meta.StoredAt = time.Now().Unix()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeMeta(entry.key, entry.meta)
+}
+
+// store writes resp (with body already fully read into bodyBytes) to
+// disk under the key derived from req and resp's own Vary header, then
+// evicts the oldest entries if the cache now exceeds MaxSizeBytes.
+func (c *Cache) store(req *HTTPMessage, resp *HTTPMessage, bodyBytes []byte) error {
+	varyValue, _ := resp.Headers.Get("Vary")
+	varyNames := splitAndTrim(varyValue)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.writeVaryNames(c.primaryKey(req), varyNames); err != nil {
+		return err
+	}
+	key := c.entryKey(req, varyNames)
+	meta := cacheMeta{
+		StatusLine: resp.StartLine,
+		Headers:    resp.Headers.All(),
+		StoredAt:   time.Now().Unix(),
+		BodySize:   int64(len(bodyBytes)),
+	}
+	if err := c.writeMeta(key, meta); err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.bodyPath(key), bodyBytes, 0o644); err != nil {
+		return err
+	}
+	c.evictLocked()
+	return nil
+}
+
+func (c *Cache) writeMeta(key string, meta cacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.metaPath(key), data, 0o644)
+}
+
+// evictLocked removes the least-recently-stored entries until the
+// cache's total body size is back under maxSizeBytes. Callers must hold
+// c.mu.
+func (c *Cache) evictLocked() {
+	if c.maxSizeBytes <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	type bodyFile struct {
+		key      string
+		size     int64
+		storedAt int64
+	}
+	var bodies []bodyFile
+	var total int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".body") {
+			continue
+		}
+		key := strings.TrimSuffix(name, ".body")
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		total += info.Size()
+
+		storedAt := info.ModTime().Unix()
+		if metaData, err := os.ReadFile(c.metaPath(key)); err == nil {
+			var meta cacheMeta
+			if json.Unmarshal(metaData, &meta) == nil {
+				storedAt = meta.StoredAt
+			}
+		}
+		bodies = append(bodies, bodyFile{key: key, size: info.Size(), storedAt: storedAt})
+	}
+	if total <= c.maxSizeBytes {
+		return
+	}
+
+	sort.Slice(bodies, func(i, j int) bool { return bodies[i].storedAt < bodies[j].storedAt })
+	for _, b := range bodies {
+		if total <= c.maxSizeBytes {
+			break
+		}
+		os.Remove(c.bodyPath(b.key))
+		os.Remove(c.metaPath(b.key))
+		total -= b.size
+	}
+}
+
+func splitAndTrim(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// bufferBody reads msg.Body up to the cache's MaxSizeBytes, leaving
+// msg.Body positioned to be read again from the start so the response
+// can still be forwarded to the client whether or not it ends up cached.
+// ok is false when the body is larger than MaxSizeBytes, in which case
+// the caller should skip storing it but msg.Body is unaffected.
+func (c *Cache) bufferBody(msg *HTTPMessage) (data []byte, ok bool, err error) {
+	if c.maxSizeBytes <= 0 {
+		data, err = io.ReadAll(msg.Body)
+		if err != nil {
+			return nil, false, err
+		}
+		msg.Body = bytes.NewReader(data)
+		return data, true, nil
+	}
+	data, err = io.ReadAll(io.LimitReader(msg.Body, c.maxSizeBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(data)) > c.maxSizeBytes {
+		msg.Body = io.MultiReader(bytes.NewReader(data), msg.Body)
+		return nil, false, nil
+	}
+	msg.Body = bytes.NewReader(data)
+	return data, true, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestEntry(headers []HeaderField, storedAt time.Time) *cachedEntry {
+	return &cachedEntry{
+		meta: cacheMeta{
+			StatusLine: "HTTP/1.1 200 OK",
+			Headers:    headers,
+			StoredAt:   storedAt.Unix(),
+		},
+	}
+}
+
+func TestCachedEntryFreshnessLifetime(t *testing.T) {
+	now := time.Now()
+
+	t.Run("max-age", func(t *testing.T) {
+		e := newTestEntry([]HeaderField{{Name: "Cache-Control", Value: "max-age=60"}}, now)
+		lifetime, ok := e.freshnessLifetime()
+		if !ok || lifetime != 60*time.Second {
+			t.Fatalf("freshnessLifetime() = %v, %v; want 60s, true", lifetime, ok)
+		}
+	})
+
+	t.Run("s-maxage takes precedence over max-age", func(t *testing.T) {
+		e := newTestEntry([]HeaderField{{Name: "Cache-Control", Value: "max-age=60, s-maxage=120"}}, now)
+		lifetime, ok := e.freshnessLifetime()
+		if !ok || lifetime != 120*time.Second {
+			t.Fatalf("freshnessLifetime() = %v, %v; want 120s, true", lifetime, ok)
+		}
+	})
+
+	t.Run("expires minus date", func(t *testing.T) {
+		date := now.Truncate(time.Second)
+		expires := date.Add(30 * time.Second)
+		e := newTestEntry([]HeaderField{
+			{Name: "Date", Value: date.UTC().Format(time.RFC1123)},
+			{Name: "Expires", Value: expires.UTC().Format(time.RFC1123)},
+		}, now)
+		lifetime, ok := e.freshnessLifetime()
+		if !ok || lifetime != 30*time.Second {
+			t.Fatalf("freshnessLifetime() = %v, %v; want 30s, true", lifetime, ok)
+		}
+	})
+
+	t.Run("no freshness info", func(t *testing.T) {
+		e := newTestEntry(nil, now)
+		if _, ok := e.freshnessLifetime(); ok {
+			t.Fatalf("freshnessLifetime() ok = true, want false")
+		}
+	})
+}
+
+func TestCachedEntryIsFresh(t *testing.T) {
+	t.Run("within lifetime", func(t *testing.T) {
+		e := newTestEntry([]HeaderField{{Name: "Cache-Control", Value: "max-age=3600"}}, time.Now())
+		if !e.isFresh() {
+			t.Fatalf("isFresh() = false, want true")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		e := newTestEntry([]HeaderField{{Name: "Cache-Control", Value: "max-age=1"}}, time.Now().Add(-time.Hour))
+		if e.isFresh() {
+			t.Fatalf("isFresh() = true, want false")
+		}
+	})
+
+	t.Run("no freshness lifetime is never fresh", func(t *testing.T) {
+		e := newTestEntry(nil, time.Now())
+		if e.isFresh() {
+			t.Fatalf("isFresh() = true, want false")
+		}
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CompressionConfig controls transparent gzip compression of upstream
+// responses for clients that advertise support for it.
+type CompressionConfig struct {
+	Enabled           bool     `json:"enabled"`
+	Level             int      `json:"level"`
+	MinSizeBytes      int64    `json:"minSizeBytes"`
+	CompressibleTypes []string `json:"compressibleTypes"`
+}
+
+// defaultCompressibleTypes is used when a CompressionConfig doesn't name
+// its own list of Content-Types worth compressing. An entry ending in
+// "/" matches as a prefix, e.g. "text/" matches "text/html".
+var defaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// acceptsGzip reports whether headers' Accept-Encoding includes gzip.
+func acceptsGzip(headers *HeaderList) bool {
+	for _, ae := range headers.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(ae, ",") {
+			name := strings.SplitN(strings.TrimSpace(enc), ";", 2)[0]
+			if strings.EqualFold(name, "gzip") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isCompressibleContentType reports whether ct matches one of types.
+func isCompressibleContentType(ct string, types []string) bool {
+	if idx := strings.IndexByte(ct, ';'); idx != -1 {
+		ct = ct[:idx]
+	}
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if strings.HasSuffix(t, "/") {
+			if strings.HasPrefix(ct, t) {
+				return true
+			}
+			continue
+		}
+		if ct == t {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldCompressResponse reports whether resp should be gzip-compressed
+// before being written to a client that has advertised gzip support.
+func shouldCompressResponse(resp *HTTPMessage, clientAcceptsGzip bool, cfg *CompressionConfig) bool {
+	if cfg == nil || !cfg.Enabled || !clientAcceptsGzip {
+		return false
+	}
+	// gzip.Writer only flushes its internal buffer on Close, which would
+	// hold a streaming response (SSE, long-poll) back until the stream
+	// ends, defeating the immediate-flush behavior isStreamingResponse
+	// exists for. Never compress those.
+	if isStreamingResponse(resp) {
+		return false
+	}
+	if _, alreadyEncoded := resp.Headers.Get("Content-Encoding"); alreadyEncoded {
+		return false
+	}
+	ct, _ := resp.Headers.Get("Content-Type")
+	types := cfg.CompressibleTypes
+	if len(types) == 0 {
+		types = defaultCompressibleTypes
+	}
+	if !isCompressibleContentType(ct, types) {
+		return false
+	}
+	if cl, ok := resp.Headers.Get("Content-Length"); ok {
+		n, err := strconv.ParseInt(strings.TrimSpace(cl), 10, 64)
+		if err != nil || n < cfg.MinSizeBytes {
+			return false
+		}
+	}
+	return true
+}
+
+// prepareCompressedHeaders rewrites resp's framing and encoding headers
+// to advertise the gzip body the caller is about to write: the
+// compressed length isn't known up front, so the body switches to
+// chunked framing, and Vary must include Accept-Encoding so caches don't
+// serve the compressed response to a client that can't decode it.
+func prepareCompressedHeaders(headers *HeaderList) {
+	headers.Del("Content-Length")
+	headers.Set("Transfer-Encoding", "chunked")
+	headers.Set("Content-Encoding", "gzip")
+	addVary(headers, "Accept-Encoding")
+}
+
+// addVary appends name to Vary if it isn't already named there.
+func addVary(headers *HeaderList, name string) {
+	for _, v := range headers.Values("Vary") {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), name) {
+				return
+			}
+		}
+	}
+	if existing, ok := headers.Get("Vary"); ok && existing != "" {
+		headers.Set("Vary", existing+", "+name)
+	} else {
+		headers.Set("Vary", name)
+	}
+}
+
+// newCompressWriter wraps w in a gzip.Writer at level, falling back to
+// gzip's default level if level isn't one gzip accepts.
+func newCompressWriter(w io.Writer, level int) *gzip.Writer {
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		gz = gzip.NewWriter(w)
+	}
+	return gz
+}
+
+// decompressUpstreamBody transparently gunzips resp.Body when the
+// upstream sent Content-Encoding: gzip but the client never advertised
+// support for it, rewriting the framing headers to match since the
+// decompressed length isn't known up front. It reports whether it
+// applied.
+func decompressUpstreamBody(resp *HTTPMessage, clientAcceptsGzip bool) (bool, error) {
+	if clientAcceptsGzip {
+		return false, nil
+	}
+	ce, ok := resp.Headers.Get("Content-Encoding")
+	if !ok || !strings.EqualFold(strings.TrimSpace(ce), "gzip") {
+		return false, nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	resp.Body = gz
+	resp.Headers.Del("Content-Encoding")
+	resp.Headers.Del("Content-Length")
+	resp.Headers.Set("Transfer-Encoding", "chunked")
+	return true, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func TestCompressDecompressRoundTrip(t *testing.T) {
+	want := []byte("the quick brown fox jumps over the lazy dog, repeated for good measure")
+
+	var buf bytes.Buffer
+	gz := newCompressWriter(&buf, gzip.DefaultCompression)
+	if _, err := gz.Write(want); err != nil {
+		t.Fatalf("writing to gzip writer: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("closing gzip writer: %v", err)
+	}
+
+	resp := &HTTPMessage{
+		StartLine: "HTTP/1.1 200 OK",
+		Headers:   NewHeaderList(),
+		Body:      bytes.NewReader(buf.Bytes()),
+	}
+	resp.Headers.Set("Content-Encoding", "gzip")
+
+	applied, err := decompressUpstreamBody(resp, false)
+	if err != nil {
+		t.Fatalf("decompressUpstreamBody: %v", err)
+	}
+	if !applied {
+		t.Fatalf("decompressUpstreamBody applied = false, want true")
+	}
+
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading decompressed body: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("round trip mismatch: got %q, want %q", got, want)
+	}
+	if _, ok := resp.Headers.Get("Content-Encoding"); ok {
+		t.Errorf("Content-Encoding still set after decompression")
+	}
+}
+
+func TestShouldCompressResponseExcludesStreaming(t *testing.T) {
+	cfg := &CompressionConfig{Enabled: true, MinSizeBytes: 0}
+
+	headers := NewHeaderList()
+	headers.Set("Content-Type", "text/event-stream")
+	resp := &HTTPMessage{StartLine: "HTTP/1.1 200 OK", Headers: headers}
+
+	if shouldCompressResponse(resp, true, cfg) {
+		t.Errorf("shouldCompressResponse = true for an SSE response, want false")
+	}
+}
+
+func TestShouldCompressResponseCompressesOrdinaryBody(t *testing.T) {
+	cfg := &CompressionConfig{Enabled: true, MinSizeBytes: 0}
+
+	headers := NewHeaderList()
+	headers.Set("Content-Type", "text/html")
+	headers.Set("Content-Length", "100")
+	resp := &HTTPMessage{StartLine: "HTTP/1.1 200 OK", Headers: headers}
+
+	if !shouldCompressResponse(resp, true, cfg) {
+		t.Errorf("shouldCompressResponse = false for an ordinary text/html response, want true")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpstreamConfig describes a single backend server as read from a config
+// file or the -upstreams flag.
+type UpstreamConfig struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+}
+
+// Config holds everything runHttpProxy needs to stand up the pool and the
+// health checker. It can be populated from a JSON file (-config) or from
+// individual flags when no file is given.
+type Config struct {
+	ListenAddr          string             `json:"listenAddr"`
+	Upstreams           []UpstreamConfig   `json:"upstreams"`
+	Policy              string             `json:"policy"` // "round-robin", "least-connections", "random"
+	HealthCheckPath     string             `json:"healthCheckPath"`
+	HealthCheckInterval time.Duration      `json:"healthCheckInterval"`
+	MaxDialRetries      int                `json:"maxDialRetries"`
+	TunnelAllowedPorts  map[int]bool       `json:"tunnelAllowedPorts"`
+	FlushInterval       time.Duration      `json:"flushInterval"`
+	TrustedProxyCIDRs   []string           `json:"trustedProxyCIDRs"`
+	HeaderRules         *HeaderRules       `json:"headerRules"`
+	Cache               *CacheConfig       `json:"cache"`
+	Compression         *CompressionConfig `json:"compression"`
+}
+
+// loadConfig parses flags and builds a Config from them. If -config points
+// at a file, the Config is read from that file alone: the other flags are
+// ignored, and any field the file omits is left at its zero value.
+func loadConfig() (*Config, error) {
+	configPath := flag.String("config", "", "path to a JSON config file (overrides other flags)")
+	listenAddr := flag.String("listen", "127.0.0.1:8000", "address for the proxy to listen on")
+	upstreamsFlag := flag.String("upstreams", "127.0.0.1:9000", "comma-separated list of upstream addresses")
+	policy := flag.String("policy", "round-robin", "upstream selection policy: round-robin, least-connections, random")
+	healthCheckPath := flag.String("health-check-path", "/health", "path used for upstream health checks")
+	healthCheckInterval := flag.Duration("health-check-interval", 5*time.Second, "interval between upstream health checks")
+	maxDialRetries := flag.Int("max-dial-retries", 2, "additional upstreams to try before returning 502")
+	tunnelAllowedPorts := flag.String("tunnel-allowed-ports", "443,80", "comma-separated ports CONNECT tunnels may target")
+	flushInterval := flag.Duration("flush-interval", 0, "streaming response flush cadence: 0 or negative flushes after every write, positive flushes on that interval")
+	trustedProxyCIDRs := flag.String("trusted-proxy-cidrs", "", "comma-separated CIDRs allowed to extend an existing X-Forwarded-For")
+	cacheEnabled := flag.Bool("cache-enabled", false, "cache cacheable GET/HEAD responses on disk")
+	cacheDir := flag.String("cache-dir", "proxy-cache", "directory to store cached responses in")
+	cacheMaxSizeBytes := flag.Int64("cache-max-size-bytes", 100*1024*1024, "evict least-recently-stored cache entries past this total size")
+	compressionEnabled := flag.Bool("compression-enabled", false, "gzip-compress compressible responses for clients that advertise gzip support")
+	compressionLevel := flag.Int("compression-level", gzip.DefaultCompression, "gzip compression level, -1 (default) to 9 (best compression)")
+	compressionMinSizeBytes := flag.Int64("compression-min-size-bytes", 1024, "skip compression for responses smaller than this (when Content-Length is known)")
+	compressionTypes := flag.String("compression-types", "", "comma-separated Content-Types (or prefixes ending in /) to compress; empty uses a built-in text/json/js/xml/svg list")
+	flag.Parse()
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		cfg := &Config{}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing config file: %w", err)
+		}
+		return cfg, nil
+	}
+
+	cfg := &Config{
+		ListenAddr:          *listenAddr,
+		Policy:              *policy,
+		HealthCheckPath:     *healthCheckPath,
+		HealthCheckInterval: *healthCheckInterval,
+		MaxDialRetries:      *maxDialRetries,
+		TunnelAllowedPorts:  parsePortSet(*tunnelAllowedPorts),
+		FlushInterval:       *flushInterval,
+		TrustedProxyCIDRs:   parseCSV(*trustedProxyCIDRs),
+		Cache: &CacheConfig{
+			Enabled:      *cacheEnabled,
+			Dir:          *cacheDir,
+			MaxSizeBytes: *cacheMaxSizeBytes,
+		},
+		Compression: &CompressionConfig{
+			Enabled:           *compressionEnabled,
+			Level:             *compressionLevel,
+			MinSizeBytes:      *compressionMinSizeBytes,
+			CompressibleTypes: parseCSV(*compressionTypes),
+		},
+	}
+	for _, addr := range strings.Split(*upstreamsFlag, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		cfg.Upstreams = append(cfg.Upstreams, UpstreamConfig{Address: addr, Weight: 1})
+	}
+	return cfg, nil
+}
+
+// parseCSV splits a comma-separated flag value into a trimmed, non-empty
+// slice.
+func parseCSV(raw string) []string {
+	var out []string
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// parsePortSet turns a comma-separated list of ports into a lookup set,
+// silently skipping entries that don't parse as a port number.
+func parsePortSet(raw string) map[int]bool {
+	ports := make(map[int]bool)
+	for _, p := range strings.Split(raw, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			continue
+		}
+		ports[port] = true
+	}
+	return ports
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// HeaderRules drives configurable header rewriting for both legs of the
+// proxy. Each Set/Add/Remove operates case-insensitively, matched
+// against HeaderList's own case-insensitive semantics.
+type HeaderRules struct {
+	RequestSet     map[string]string   `json:"requestSet"`
+	RequestAdd     map[string][]string `json:"requestAdd"`
+	RequestRemove  []string            `json:"requestRemove"`
+	ResponseSet    map[string]string   `json:"responseSet"`
+	ResponseAdd    map[string][]string `json:"responseAdd"`
+	ResponseRemove []string            `json:"responseRemove"`
+}
+
+// applyRequestHeaderRules applies rules.Request* to an outbound request.
+// A nil rules is a no-op.
+func applyRequestHeaderRules(headers *HeaderList, rules *HeaderRules) {
+	if rules == nil {
+		return
+	}
+	applyHeaderRules(headers, rules.RequestSet, rules.RequestAdd, rules.RequestRemove)
+}
+
+// applyResponseHeaderRules applies rules.Response* to an outbound
+// response. A nil rules is a no-op.
+func applyResponseHeaderRules(headers *HeaderList, rules *HeaderRules) {
+	if rules == nil {
+		return
+	}
+	applyHeaderRules(headers, rules.ResponseSet, rules.ResponseAdd, rules.ResponseRemove)
+}
+
+func applyHeaderRules(headers *HeaderList, set map[string]string, add map[string][]string, remove []string) {
+	for _, name := range remove {
+		headers.Del(name)
+	}
+	for name, value := range set {
+		headers.Set(name, value)
+	}
+	for name, values := range add {
+		for _, value := range values {
+			headers.Add(name, value)
+		}
+	}
+}
+
+// hopByHopHeaders is the standard set of headers that only apply to a
+// single connection hop and must never be forwarded to the next one.
+var hopByHopHeaders = []string{
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// stripHopByHopHeaders removes the standard hop-by-hop headers plus any
+// header the message itself named in its Connection header.
+func stripHopByHopHeaders(headers *HeaderList) {
+	for _, conn := range headers.Values("Connection") {
+		for _, name := range strings.Split(conn, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				headers.Del(name)
+			}
+		}
+	}
+	headers.Del("Connection")
+	for _, name := range hopByHopHeaders {
+		headers.Del(name)
+	}
+}
+
+// ensureOutboundFraming restores Transfer-Encoding: chunked after
+// stripHopByHopHeaders removed it, if the body we're about to write is
+// still unbounded (no Content-Length) and was chunked on the way in —
+// stripping it is correct per-hop, but the next hop still needs to know
+// how to find the end of the body we're about to re-chunk.
+func ensureOutboundFraming(headers *HeaderList, wasChunked bool) {
+	if _, hasContentLength := headers.Get("Content-Length"); hasContentLength {
+		return
+	}
+	if wasChunked {
+		headers.Set("Transfer-Encoding", "chunked")
+	}
+}
+
+// injectForwardedHeaders sets the standard reverse-proxy hop headers on
+// an outbound request: X-Forwarded-For (extended only when the client
+// itself is a trusted proxy, replaced outright otherwise), plus
+// X-Forwarded-Proto and X-Forwarded-Host.
+func injectForwardedHeaders(headers *HeaderList, clientAddr string, trustedClient bool, scheme string) {
+	clientIP := clientAddr
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		clientIP = host
+	}
+
+	if existing, ok := headers.Get("X-Forwarded-For"); ok && trustedClient {
+		headers.Set("X-Forwarded-For", existing+", "+clientIP)
+	} else {
+		headers.Set("X-Forwarded-For", clientIP)
+	}
+
+	headers.Set("X-Forwarded-Proto", scheme)
+	if host, ok := headers.Get("Host"); ok {
+		headers.Set("X-Forwarded-Host", host)
+	}
+}
+
+// isTrustedClient reports whether remoteAddr's IP falls inside one of
+// trustedCIDRs, i.e. whether the connecting peer is itself a proxy we
+// trust to have set X-Forwarded-For honestly.
+func isTrustedClient(remoteAddr string, trustedCIDRs []string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range trustedCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
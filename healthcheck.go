@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxHealthCheckBackoff caps the exponential backoff applied while an
+// upstream stays unhealthy, so a long-dead upstream is still reprobed
+// often enough to notice when it comes back.
+const maxHealthCheckBackoff = 60 * time.Second
+
+// StartHealthChecker launches one background goroutine per upstream in
+// the pool that periodically issues a GET against path over a fresh TCP
+// connection, marking the upstream healthy or unhealthy based on the
+// result.
+func StartHealthChecker(pool *Pool, path string, interval time.Duration) {
+	for _, u := range pool.Upstreams() {
+		go healthCheckLoop(u, path, interval)
+	}
+}
+
+func healthCheckLoop(u *Upstream, path string, baseInterval time.Duration) {
+	backoff := baseInterval
+	for {
+		if probeUpstream(u, path) {
+			u.setHealthy(true)
+			backoff = baseInterval
+		} else {
+			u.setHealthy(false)
+			backoff *= 2
+			if backoff > maxHealthCheckBackoff {
+				backoff = maxHealthCheckBackoff
+			}
+		}
+		time.Sleep(backoff)
+	}
+}
+
+// probeUpstream dials u fresh, issues a GET for path, and reports whether
+// the response status was 2xx.
+func probeUpstream(u *Upstream, path string) bool {
+	conn, err := net.DialTimeout("tcp", u.Address, 3*time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		return false
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+u.Address+path, nil)
+	if err != nil {
+		return false
+	}
+	if err := req.Write(conn); err != nil {
+		return false
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
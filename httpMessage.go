@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// HeaderField is a single "Name: Value" header, preserving the order and
+// casing it was seen in on the wire.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// HeaderList is an ordered collection of header fields with
+// case-insensitive lookups, matching how HTTP header names behave.
+type HeaderList struct {
+	fields []HeaderField
+}
+
+func NewHeaderList() *HeaderList {
+	return &HeaderList{}
+}
+
+// Add appends a header, keeping any existing field of the same name
+// (headers may legitimately repeat, e.g. Set-Cookie).
+func (h *HeaderList) Add(name, value string) {
+	h.fields = append(h.fields, HeaderField{Name: name, Value: value})
+}
+
+// Get returns the first value for name, case-insensitively.
+func (h *HeaderList) Get(name string) (string, bool) {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// Values returns every value for name, in the order they appeared.
+func (h *HeaderList) Values(name string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// Set replaces all existing values for name with a single value.
+func (h *HeaderList) Set(name, value string) {
+	h.Del(name)
+	h.Add(name, value)
+}
+
+// Del removes every field matching name, case-insensitively.
+func (h *HeaderList) Del(name string) {
+	out := h.fields[:0]
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.Name, name) {
+			out = append(out, f)
+		}
+	}
+	h.fields = out
+}
+
+// All returns the underlying fields in wire order.
+func (h *HeaderList) All() []HeaderField {
+	return h.fields
+}
+
+// WriteHeaders writes the headers followed by the blank line that terminates
+// an HTTP header section.
+func (h *HeaderList) WriteHeaders(w io.Writer) error {
+	for _, f := range h.fields {
+		if _, err := fmt.Fprintf(w, "%s: %s\r\n", f.Name, f.Value); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// HTTPMessage is a parsed request or status line plus headers, with Body
+// already framed to exactly this message's content per RFC 7230 so a
+// caller can read it to completion without reading into the next
+// message on the same connection.
+type HTTPMessage struct {
+	StartLine string
+	Headers   *HeaderList
+	Body      io.Reader
+
+	// CloseDelimited is true when Body's framing was close-delimited (no
+	// Content-Length or chunked Transfer-Encoding), meaning the
+	// connection this message was read from is no longer reusable once
+	// Body is fully read.
+	CloseDelimited bool
+}
+
+// readMessage reads one HTTP request or response off r: the start-line,
+// headers, and a Body reader bounded per Content-Length, chunked
+// Transfer-Encoding (trailers included), or — for responses only —
+// close-delimited framing. requestMethod is the method of the request
+// this message answers (ignored when reading a request itself; pass "")
+// — per RFC 7230 section 3.3.3 rule 1, a response to HEAD, or a 1xx/204/304
+// of any kind, has no body regardless of what Content-Length or
+// Transfer-Encoding claims.
+func readMessage(r *bufio.Reader, requestMethod string) (*HTTPMessage, error) {
+	startLine, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if startLine == "" {
+		return nil, fmt.Errorf("readMessage: empty start line")
+	}
+
+	headers := NewHeaderList()
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	body, closeDelimited, err := framedBody(r, headers, startLine, requestMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HTTPMessage{StartLine: startLine, Headers: headers, Body: body, CloseDelimited: closeDelimited}, nil
+}
+
+// readLine reads a single CRLF-terminated line from r with the
+// terminator stripped.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// isChunkedEncoding reports whether headers declare a chunked
+// Transfer-Encoding.
+func isChunkedEncoding(headers *HeaderList) bool {
+	te, ok := headers.Get("Transfer-Encoding")
+	return ok && strings.Contains(strings.ToLower(te), "chunked")
+}
+
+// framedBody returns a reader bounded to exactly the message body
+// described by headers, per RFC 7230 section 3.3.3, along with whether
+// that framing was close-delimited (read-until-EOF, so the connection
+// can't be reused for another message afterward).
+func framedBody(r *bufio.Reader, headers *HeaderList, startLine string, requestMethod string) (body io.Reader, closeDelimited bool, err error) {
+	if isBodilessResponse(startLine, requestMethod) {
+		return bytes.NewReader(nil), false, nil
+	}
+	if isChunkedEncoding(headers) {
+		return newChunkedReader(r, headers), false, nil
+	}
+	if cl, ok := headers.Get("Content-Length"); ok {
+		n, err := strconv.ParseInt(strings.TrimSpace(cl), 10, 64)
+		if err != nil || n < 0 {
+			return nil, false, fmt.Errorf("invalid Content-Length %q", cl)
+		}
+		return io.LimitReader(r, n), false, nil
+	}
+	// Requests with no framing header carry no body. Responses with no
+	// framing header are close-delimited: the body is whatever is left
+	// on the connection.
+	if strings.HasPrefix(startLine, "HTTP/") {
+		return r, true, nil
+	}
+	return bytes.NewReader(nil), false, nil
+}
+
+// isBodilessResponse reports whether startLine is a response that rule 1
+// of RFC 7230 section 3.3.3 says never has a body, regardless of what
+// Content-Length or Transfer-Encoding claims: a response to a HEAD
+// request, or any 1xx, 204, or 304.
+func isBodilessResponse(startLine string, requestMethod string) bool {
+	if !strings.HasPrefix(startLine, "HTTP/") {
+		return false
+	}
+	if strings.EqualFold(requestMethod, "HEAD") {
+		return true
+	}
+	status := statusCodeFromStartLine(startLine)
+	if status >= 100 && status < 200 {
+		return true
+	}
+	return status == 204 || status == 304
+}
+
+// statusCodeFromStartLine parses the numeric status out of a response's
+// start-line, or 0 if it can't be parsed.
+func statusCodeFromStartLine(startLine string) int {
+	fields := strings.Fields(startLine)
+	if len(fields) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(fields[1])
+	return code
+}
+
+// writeFramedMessage writes msg's start-line and headers to w, then its
+// body. Body was decoded by readMessage, so if the headers declare
+// chunked Transfer-Encoding, the body is re-encoded into chunks (with a
+// terminating 0-length chunk) to keep the message framing that the
+// headers advertise.
+func writeFramedMessage(w io.Writer, msg *HTTPMessage) error {
+	if _, err := io.WriteString(w, msg.StartLine+"\r\n"); err != nil {
+		return err
+	}
+	if err := msg.Headers.WriteHeaders(w); err != nil {
+		return err
+	}
+	if isChunkedEncoding(msg.Headers) {
+		cw := newChunkedWriter(w)
+		if _, err := io.Copy(cw, msg.Body); err != nil {
+			return err
+		}
+		return cw.Close()
+	}
+	_, err := io.Copy(w, msg.Body)
+	return err
+}
+
+// chunkedWriter re-encodes a body as HTTP chunked Transfer-Encoding.
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func newChunkedWriter(w io.Writer) *chunkedWriter {
+	return &chunkedWriter{w: w}
+}
+
+func (c *chunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(c.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	if _, err := c.w.Write(p); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(c.w, "\r\n"); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes the terminating 0-length chunk that ends a chunked body.
+func (c *chunkedWriter) Close() error {
+	_, err := io.WriteString(c.w, "0\r\n\r\n")
+	return err
+}
+
+// chunkedBodyReader decodes an HTTP chunked body, appending any trailer
+// fields to headers once the terminating 0-length chunk is reached.
+type chunkedBodyReader struct {
+	r         *bufio.Reader
+	headers   *HeaderList
+	remaining int64
+	done      bool
+	err       error
+}
+
+func newChunkedReader(r *bufio.Reader, headers *HeaderList) io.Reader {
+	return &chunkedBodyReader{r: r, headers: headers}
+}
+
+func (c *chunkedBodyReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunkSize(); err != nil {
+			c.err = err
+			return 0, err
+		}
+		if c.remaining == 0 {
+			if err := c.readTrailers(); err != nil {
+				c.err = err
+				return 0, err
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+	}
+
+	max := int64(len(p))
+	if max > c.remaining {
+		max = c.remaining
+	}
+	n, err := c.r.Read(p[:max])
+	c.remaining -= int64(n)
+	if err != nil {
+		c.err = err
+		return n, err
+	}
+	if c.remaining == 0 {
+		// consume the CRLF that terminates this chunk's data
+		if _, err := readLine(c.r); err != nil {
+			c.err = err
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (c *chunkedBodyReader) nextChunkSize() error {
+	line, err := readLine(c.r)
+	if err != nil {
+		return err
+	}
+	sizeStr := line
+	if idx := strings.IndexByte(line, ';'); idx != -1 {
+		sizeStr = line[:idx]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+	if err != nil {
+		return fmt.Errorf("invalid chunk size %q: %w", line, err)
+	}
+	c.remaining = size
+	return nil
+}
+
+func (c *chunkedBodyReader) readTrailers() error {
+	for {
+		line, err := readLine(c.r)
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if c.headers != nil {
+			c.headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadMessageFraming(t *testing.T) {
+	cases := []struct {
+		name          string
+		requestMethod string
+		raw           string
+		wantBody      string
+		wantTrailer   string
+	}{
+		{
+			name:          "content-length",
+			requestMethod: "",
+			raw:           "GET / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+			wantBody:      "hello",
+		},
+		{
+			name:          "chunked with trailers",
+			requestMethod: "",
+			raw:           "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Trailer: yes\r\n\r\n",
+			wantBody:      "hello",
+			wantTrailer:   "yes",
+		},
+		{
+			name:          "HEAD response is bodiless",
+			requestMethod: "HEAD",
+			raw:           "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			wantBody:      "",
+		},
+		{
+			name:          "204 response is bodiless",
+			requestMethod: "",
+			raw:           "HTTP/1.1 204 No Content\r\nContent-Length: 5\r\n\r\nhello",
+			wantBody:      "",
+		},
+		{
+			name:          "304 response is bodiless",
+			requestMethod: "",
+			raw:           "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\nhello",
+			wantBody:      "",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tc.raw))
+			msg, err := readMessage(r, tc.requestMethod)
+			if err != nil {
+				t.Fatalf("readMessage: %v", err)
+			}
+			body, err := io.ReadAll(msg.Body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			if string(body) != tc.wantBody {
+				t.Errorf("body = %q, want %q", body, tc.wantBody)
+			}
+			if tc.wantTrailer != "" {
+				got, _ := msg.Headers.Get("X-Trailer")
+				if got != tc.wantTrailer {
+					t.Errorf("trailer X-Trailer = %q, want %q", got, tc.wantTrailer)
+				}
+			}
+			if msg.CloseDelimited {
+				t.Errorf("CloseDelimited = true, want false")
+			}
+		})
+	}
+}
+
+func TestFramedBodyCloseDelimited(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\n\r\nthe rest of the connection"))
+	msg, err := readMessage(r, "")
+	if err != nil {
+		t.Fatalf("readMessage: %v", err)
+	}
+	if !msg.CloseDelimited {
+		t.Fatalf("CloseDelimited = false, want true for a response with no framing header")
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	if string(body) != "the rest of the connection" {
+		t.Errorf("body = %q, want the rest of the connection", body)
+	}
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"log"
@@ -9,16 +10,38 @@ import (
 	"strings"
 )
 
-//TODO:  gzip, content caching
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	runHttpProxy(cfg)
+}
+
+func runHttpProxy(cfg *Config) {
+	upstreams := make([]*Upstream, 0, len(cfg.Upstreams))
+	for _, uc := range cfg.Upstreams {
+		upstreams = append(upstreams, NewUpstream(uc.Address, uc.Weight))
+	}
+	pool := NewPool(upstreams, cfg.Policy)
+	StartHealthChecker(pool, cfg.HealthCheckPath, cfg.HealthCheckInterval)
 
-func runHttpProxy() {
-	listener, err := net.Listen("tcp", "127.0.0.1:8000")
+	var cache *Cache
+	if cfg.Cache != nil && cfg.Cache.Enabled {
+		c, err := NewCache(cfg.Cache)
+		if err != nil {
+			log.Fatalf("Error initializing cache: %v", err)
+		}
+		cache = c
+	}
+
+	listener, err := net.Listen("tcp", cfg.ListenAddr)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
 	defer listener.Close()
 
-	log.Println("Proxy server listening on port 8000")
+	log.Printf("Proxy server listening on %s", cfg.ListenAddr)
 
 	for {
 		clientConn, err := listener.Accept()
@@ -28,125 +51,157 @@ func runHttpProxy() {
 		}
 		log.Printf("Accepted new connection")
 
-		go handleProxyConnection(clientConn)
+		go handleProxyConnection(clientConn, pool, cfg, cache)
 	}
 }
 
-func handleProxyConnection(clientConn net.Conn) {
+// handleProxyConnection serves one client connection, processing one
+// request/response exchange at a time and looping for as long as the
+// client keeps the connection alive. Framing (Content-Length, chunked,
+// close-delimited) is handled by readMessage, so pipelined or
+// keep-alive requests never get mixed up with each other.
+func handleProxyConnection(clientConn net.Conn, pool *Pool, cfg *Config, cache *Cache) {
 	defer clientConn.Close()
 
-	// Create persistent connection to the upstream
-	upstreamConn, err := net.Dial("tcp", "127.0.0.1:9000")
-	if err != nil {
-		log.Printf("Error connecting to upstream: %v", err)
-		return
+	clientReader := bufio.NewReader(clientConn)
+	clientAddr := clientConn.RemoteAddr().String()
+	trustedClient := isTrustedClient(clientAddr, cfg.TrustedProxyCIDRs)
+
+	// upstreamConn/upstream are dialed lazily on the first request, once we
+	// know it isn't a CONNECT (which bypasses the pool entirely).
+	var upstreamConn net.Conn
+	var upstreamReader *bufio.Reader
+	var upstream *Upstream
+
+	// closeUpstream tears down the current upstream connection, if any,
+	// so the next iteration of the loop dials a fresh one. It's called
+	// both mid-loop, when the upstream's own response indicates the
+	// connection can't be reused, and once at function exit via defer.
+	closeUpstream := func() {
+		if upstreamConn != nil {
+			upstreamConn.Close()
+			upstream.release()
+			upstreamConn, upstreamReader, upstream = nil, nil, nil
+		}
 	}
-	// Close upstreamConn when the client or proxy is done
-	defer upstreamConn.Close()
+	defer closeUpstream()
 
-	buffer := make([]byte, 4096)
 	for {
-		// Read one request from the client
-		n, err := clientConn.Read(buffer)
+		req, err := readMessage(clientReader, "")
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("Error reading from client: %v", err)
+				log.Printf("Error reading request from client: %v", err)
 			}
 			return
 		}
-		if n == 0 {
-			// client closed the connection
-			return
-		}
-
-		request := string(buffer[:n])
-		version, connectionHeader := parseHTTPHeaders(request)
 
-		// Forward the request to our persistent upstream connection
-		_, err = upstreamConn.Write(buffer[:n])
-		if err != nil {
-			log.Printf("Error writing to upstream: %v", err)
+		if strings.HasPrefix(req.StartLine, "CONNECT ") {
+			handleConnectTunnel(clientConn, clientReader, req.StartLine, cfg.TunnelAllowedPorts)
 			return
 		}
 
-		// For true streaming, we can spin up two goroutines to copy data
-		// in both directions. But that means we need to know
-		// when one request/response ends and the next begins.
-		// This code just demonstrates a naive approach: it does
-		// a bidirectional copy for this 'request' cycle.
-
-		done1 := make(chan struct{})
-		done2 := make(chan struct{})
-
-		// Upstream -> Client
-		go func() {
-			proxyData(upstreamConn, clientConn, "UPSTREAM -> CLIENT")
-			close(done1)
-		}()
-
-		// Client -> Upstream
-		go func() {
-			proxyData(clientConn, upstreamConn, "CLIENT -> UPSTREAM")
-			close(done2)
-		}()
-
-		// Wait until both directions have finished this request cycle
-		<-done1
-		<-done2
-
-		// DO NOT close upstreamConn here — we want to reuse it
-		// Instead, check if the client wants to keep the connection open
-		if shouldKeepAlive(version, connectionHeader) {
-			log.Println("Connection kept alive for next request.")
-			continue
-		} else {
-			log.Println("Connection closing (not keep-alive).")
-			break
+		// The client's own Connection header governs keep-alive and must be
+		// read before stripHopByHopHeaders removes it.
+		version, connectionHeader := requestVersionAndConnection(req)
+		clientAcceptsGzip := acceptsGzip(req.Headers)
+
+		cacheable := cache != nil && isCacheableRequest(req)
+		var revalidating *cachedEntry
+		if cacheable {
+			if entry, ok := cache.lookup(req); ok {
+				if entry.isFresh() {
+					if err := proxyResponseWithHeaderInjection(entry.toResponse(), clientConn, clientAcceptsGzip, cfg); err != nil {
+						log.Printf("Error writing cached response to client: %v", err)
+						return
+					}
+					if shouldKeepAlive(version, connectionHeader) {
+						continue
+					}
+					return
+				}
+				if _, _, ok := entry.validators(); ok {
+					entry.addRevalidationHeaders(req)
+					revalidating = entry
+				}
+			}
 		}
-	}
-}
-
-// proxyData just copies data from srcConn to destConn until EOF or error
-func proxyData(srcConn, destConn net.Conn, proxyDir string) {
 
-	//simple header modification when sending back to client
-	//TODO need to make this more dynamic
-	if proxyDir == "UPSTREAM -> CLIENT" {
-		proxyResponseWithHeaderInjection(srcConn, destConn)
-		return
-	}
-
-	buf := make([]byte, 4096)
-	for {
-		n, err := srcConn.Read(buf)
-		if n > 0 {
-			_, writeErr := destConn.Write(buf[:n])
-			if writeErr != nil {
-				log.Printf("Error writing data: %v", writeErr)
+		if upstreamConn == nil {
+			upstreamConn, upstream, err = dialUpstream(pool, cfg.MaxDialRetries)
+			if err != nil {
+				log.Printf("Error connecting to upstream: %v", err)
+				clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
 				return
 			}
+			upstream.acquire()
+			upstreamReader = bufio.NewReader(upstreamConn)
 		}
+
+		wasChunked := isChunkedEncoding(req.Headers)
+		applyRequestHeaderRules(req.Headers, cfg.HeaderRules)
+		stripHopByHopHeaders(req.Headers)
+		injectForwardedHeaders(req.Headers, clientAddr, trustedClient, "http")
+		ensureOutboundFraming(req.Headers, wasChunked)
+
+		if err := writeFramedMessage(upstreamConn, req); err != nil {
+			log.Printf("Error writing request to upstream: %v", err)
+			return
+		}
+
+		resp, err := readMessage(upstreamReader, requestMethodOf(req))
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading data: %v", err)
+			log.Printf("Error reading response from upstream: %v", err)
+			return
+		}
+
+		if revalidating != nil && responseStatusCode(resp) == 304 {
+			if err := cache.refreshFrom304(revalidating, resp); err != nil {
+				log.Printf("Error refreshing cache entry: %v", err)
 			}
+			resp = revalidating.toResponse()
+		} else if cacheable && responseStatusCode(resp) == 200 && cache.isCacheableResponse(resp) {
+			if bodyBytes, ok, err := cache.bufferBody(resp); err != nil {
+				log.Printf("Error buffering response body for cache: %v", err)
+			} else if ok {
+				if err := cache.store(req, resp, bodyBytes); err != nil {
+					log.Printf("Error storing response in cache: %v", err)
+				}
+			}
+		}
+
+		if err := proxyResponseWithHeaderInjection(resp, clientConn, clientAcceptsGzip, cfg); err != nil {
+			log.Printf("Error writing response to client: %v", err)
 			return
 		}
+
+		// The upstream's own framing governs whether upstreamConn can be
+		// reused for the next request: a close-delimited body or an
+		// explicit Connection: close means the socket is already dead
+		// (or about to be closed by the upstream), regardless of what
+		// the client asked for.
+		upstreamVersion, upstreamConnectionHeader := requestVersionAndConnection(resp)
+		if resp.CloseDelimited || !shouldKeepAlive(upstreamVersion, upstreamConnectionHeader) {
+			closeUpstream()
+		}
+
+		if shouldKeepAlive(version, connectionHeader) {
+			log.Println("Connection kept alive for next request.")
+			continue
+		}
+		log.Println("Connection closing (not keep-alive).")
+		return
 	}
 }
 
-// parseHTTPHeaders extracts the HTTP version and Connection header
-func parseHTTPHeaders(request string) (version, connection string) {
-	if idx := strings.Index(request, "HTTP/"); idx != -1 && len(request) > idx+8 {
-		version = request[idx+5 : idx+8]
-	}
-	lines := bytes.Split([]byte(request), []byte("\r\n"))
-	for _, line := range lines {
-		if bytes.HasPrefix(line, []byte("Connection:")) {
-			connection = strings.TrimSpace(string(line[len("Connection: "):]))
-			break
-		}
+// requestVersionAndConnection extracts the HTTP version from a message's
+// start-line and its Connection header, for the keep-alive decision. It
+// works on both requests and responses, since both start-lines carry
+// "HTTP/x.y" at a fixed offset from the "HTTP/" marker.
+func requestVersionAndConnection(msg *HTTPMessage) (version, connection string) {
+	if idx := strings.Index(msg.StartLine, "HTTP/"); idx != -1 && len(msg.StartLine) >= idx+8 {
+		version = msg.StartLine[idx+5 : idx+8]
 	}
+	connection, _ = msg.Headers.Get("Connection")
 	return version, connection
 }
 
@@ -166,95 +221,79 @@ func shouldKeepAlive(version, connHeader string) bool {
 	return false
 }
 
-func proxyResponseWithHeaderInjection(upstream net.Conn, client net.Conn) error {
-	// Need to avoid modifying the body and only modify the headers
-	var headerBuf bytes.Buffer
-	// We read one byte at a time and stop once it reaches "\r\n\r\n" in the headerBuf.
-	tmp := make([]byte, 1)
-	for {
-		n, err := upstream.Read(tmp)
-		if err != nil {
-			return fmt.Errorf("error reading response header: %w", err)
-		}
-		if n > 0 {
-			headerBuf.Write(tmp[:n])
-		}
-		// Check if we’ve reached the end of headers
-		if bytes.Contains(headerBuf.Bytes(), []byte("\r\n\r\n")) {
-			break
-		}
+// proxyResponseWithHeaderInjection writes resp to client, applying
+// cfg.HeaderRules and stripping hop-by-hop headers along the way. If the
+// upstream sent a gzip body the client didn't ask for, it's decompressed
+// on the fly; if the client asked for gzip and cfg.Compression allows
+// it, the body is compressed on the fly instead. Streaming responses
+// (SSE, chunked, or a 200 with no Content-Length) are copied through a
+// flushWriter so bytes reach the client as they arrive instead of
+// waiting for a full buffer; everything else uses a plain bulk copy.
+func proxyResponseWithHeaderInjection(resp *HTTPMessage, client net.Conn, clientAcceptsGzip bool, cfg *Config) error {
+	wasChunked := isChunkedEncoding(resp.Headers)
+	applyResponseHeaderRules(resp.Headers, cfg.HeaderRules)
+	stripHopByHopHeaders(resp.Headers)
+	ensureOutboundFraming(resp.Headers, wasChunked)
+
+	if _, err := decompressUpstreamBody(resp, clientAcceptsGzip); err != nil {
+		return fmt.Errorf("error decompressing upstream response body: %w", err)
 	}
 
-	rawHeaders := headerBuf.Bytes()
-	parts := bytes.SplitN(rawHeaders, []byte("\r\n\r\n"), 2)
-	if len(parts) < 2 {
-		return fmt.Errorf("malformed HTTP response headers")
+	compress := shouldCompressResponse(resp, clientAcceptsGzip, cfg.Compression)
+	if compress {
+		prepareCompressedHeaders(resp.Headers)
 	}
-	headerSection := parts[0]
-	leftover := parts[1]
-
-	lines := bytes.Split(headerSection, []byte("\r\n"))
-	lines = append(lines, []byte("Foo: Bar"))
 
-	// Reassemble the headers
-	modifiedHeader := bytes.Join(lines, []byte("\r\n"))
-	modifiedHeader = append(modifiedHeader, []byte("\r\n\r\n")...)
-
-	// Write modified headers to the client
-	if _, err := client.Write(modifiedHeader); err != nil {
+	if _, err := io.WriteString(client, resp.StartLine+"\r\n"); err != nil {
+		return fmt.Errorf("error writing response status line to client: %w", err)
+	}
+	if err := resp.Headers.WriteHeaders(client); err != nil {
 		return fmt.Errorf("error writing modified headers to client: %w", err)
 	}
 
-	// Write any leftover (the beginning of the body) to the client
-	if len(leftover) > 0 {
-		if _, err := client.Write(leftover); err != nil {
-			return fmt.Errorf("error writing leftover body data to client: %w", err)
-		}
+	var bodyDst io.Writer = client
+	var fw *flushWriter
+	if isStreamingResponse(resp) {
+		fw = newFlushWriter(client, cfg.FlushInterval)
+		bodyDst = fw
 	}
 
-	// NOTE: We immediately forward any leftover body bytes we already read (leftoverBody) to the client
-	// That chunk might be large or small, or even zero bytes if we happened to read exactly up to the end of the headers and no further
-	// This is because even though we read up unitl \r\n\r\n, the reading process can "overshoot" and it may read some bytes that are actually the body because they arrived in the same TCP packet
-	// So, we send the leftovers first and then io.Copy the rest or just copyData
+	// Transfer-codings apply outermost-last on the wire, so chunked
+	// framing (the outermost coding per resp.Headers) must wrap the
+	// client/flushWriter before gzip (an inner content-coding) wraps
+	// that: resp.Body -> gzip -> chunkedWriter -> client. Closing them
+	// in the same order flushes gzip's trailer into the chunk stream
+	// before the chunk stream's own terminator is written.
+	var cw *chunkedWriter
+	if isChunkedEncoding(resp.Headers) {
+		cw = newChunkedWriter(bodyDst)
+		bodyDst = cw
+	}
 
-	// Copy the remainder of the body as-is, including chunked or not
-	// We do NOT modify the body any further
-	err := copyData(client, upstream)
-	if err != nil {
-		// handle or log error
+	var gz *gzip.Writer
+	if compress {
+		gz = newCompressWriter(bodyDst, cfg.Compression.Level)
+		bodyDst = gz
 	}
 
-	// copyData is essentially io.Copy - just doing it myself
-	// _, err := io.Copy(client, upstream)
-	return err
-}
+	if _, err := io.Copy(bodyDst, resp.Body); err != nil {
+		return fmt.Errorf("error writing response body to client: %w", err)
+	}
 
-func copyData(dst io.Writer, src io.Reader) error {
-	buf := make([]byte, 32*1024)
-	for {
-		n, readErr := src.Read(buf)
-		if n > 0 {
-			written, writeErr := dst.Write(buf[:n])
-			if writeErr != nil {
-				return fmt.Errorf("write error: %w", writeErr)
-			}
-			if written < n {
-				offset := written
-				for offset < n {
-					w, werr := dst.Write(buf[offset:n])
-					if werr != nil {
-						return fmt.Errorf("write error: %w", werr)
-					}
-					offset += w
-				}
-			}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("error closing gzip response body: %w", err)
 		}
-		if readErr != nil {
-			if readErr == io.EOF {
-				// End of data
-				return nil
-			}
-			return fmt.Errorf("read error: %w", readErr)
+	}
+	if cw != nil {
+		if err := cw.Close(); err != nil {
+			return fmt.Errorf("error closing chunked response body: %w", err)
+		}
+	}
+	if fw != nil {
+		if err := fw.Close(); err != nil {
+			return fmt.Errorf("error flushing streaming response to client: %w", err)
 		}
 	}
+	return nil
 }
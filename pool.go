@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Upstream represents a single backend server tracked by a Pool.
+type Upstream struct {
+	Address string
+	Weight  int // relative selection weight; see Pool.Next
+
+	inFlight int64 // atomic
+	healthy  int32 // atomic; 1 = healthy, 0 = unhealthy
+}
+
+// NewUpstream creates an Upstream, defaulting to healthy so it can serve
+// traffic before the first health check completes.
+func NewUpstream(address string, weight int) *Upstream {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &Upstream{Address: address, Weight: weight, healthy: 1}
+}
+
+// IsHealthy reports the upstream's last known health-check result.
+func (u *Upstream) IsHealthy() bool {
+	return atomic.LoadInt32(&u.healthy) == 1
+}
+
+func (u *Upstream) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&u.healthy, 1)
+	} else {
+		atomic.StoreInt32(&u.healthy, 0)
+	}
+}
+
+// InFlight returns the number of connections currently assigned to this
+// upstream, used by the least-connections policy.
+func (u *Upstream) InFlight() int64 {
+	return atomic.LoadInt64(&u.inFlight)
+}
+
+func (u *Upstream) acquire() {
+	atomic.AddInt64(&u.inFlight, 1)
+}
+
+func (u *Upstream) release() {
+	atomic.AddInt64(&u.inFlight, -1)
+}
+
+// Pool holds a set of upstreams and selects one per connection according
+// to a selection policy: "round-robin", "least-connections", or "random".
+type Pool struct {
+	mu        sync.Mutex
+	upstreams []*Upstream
+	policy    string
+	rrCursor  uint64
+}
+
+// NewPool builds a Pool over the given upstreams using policy. An unknown
+// policy falls back to round-robin.
+func NewPool(upstreams []*Upstream, policy string) *Pool {
+	return &Pool{upstreams: upstreams, policy: policy}
+}
+
+// Upstreams returns a snapshot of every upstream registered with the pool,
+// healthy or not.
+func (p *Pool) Upstreams() []*Upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]*Upstream, len(p.upstreams))
+	copy(out, p.upstreams)
+	return out
+}
+
+// Next returns the next upstream to use according to the pool's policy,
+// or an error if none are currently healthy. Every policy honors each
+// upstream's Weight: round-robin and random visit higher-Weight
+// upstreams proportionally more often, and least-connections compares
+// in-flight connections per unit of Weight rather than raw counts.
+func (p *Pool) Next() (*Upstream, error) {
+	healthy := p.healthyUpstreams()
+	if len(healthy) == 0 {
+		return nil, fmt.Errorf("pool: no healthy upstreams available")
+	}
+	switch p.policy {
+	case "least-connections":
+		return leastConnections(healthy), nil
+	case "random":
+		return weightedPick(healthy, rand.Intn(totalWeight(healthy))), nil
+	default: // "round-robin"
+		idx := atomic.AddUint64(&p.rrCursor, 1) - 1
+		return weightedPick(healthy, int(idx%uint64(totalWeight(healthy)))), nil
+	}
+}
+
+// totalWeight sums upstreams' Weight; NewUpstream guarantees each is at
+// least 1, so this is always positive for a non-empty slice.
+func totalWeight(upstreams []*Upstream) int {
+	total := 0
+	for _, u := range upstreams {
+		total += u.Weight
+	}
+	return total
+}
+
+// weightedPick walks upstreams in order, treating target as an offset
+// into the concatenation of each upstream's Weight-sized share, and
+// returns the upstream whose share contains it.
+func weightedPick(upstreams []*Upstream, target int) *Upstream {
+	for _, u := range upstreams {
+		target -= u.Weight
+		if target < 0 {
+			return u
+		}
+	}
+	return upstreams[len(upstreams)-1]
+}
+
+func (p *Pool) healthyUpstreams() []*Upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	healthy := make([]*Upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.IsHealthy() {
+			healthy = append(healthy, u)
+		}
+	}
+	return healthy
+}
+
+// dialUpstream picks an upstream from the pool and dials it, retrying
+// against a fresh candidate up to maxRetries times if the dial fails.
+func dialUpstream(pool *Pool, maxRetries int) (net.Conn, *Upstream, error) {
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		u, err := pool.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := net.Dial("tcp", u.Address)
+		if err != nil {
+			log.Printf("Error dialing upstream %s: %v", u.Address, err)
+			lastErr = err
+			continue
+		}
+		return conn, u, nil
+	}
+	return nil, nil, fmt.Errorf("all upstream dial attempts failed: %w", lastErr)
+}
+
+func leastConnections(upstreams []*Upstream) *Upstream {
+	best := upstreams[0]
+	bestLoad := loadRatio(best)
+	for _, u := range upstreams[1:] {
+		if load := loadRatio(u); load < bestLoad {
+			best = u
+			bestLoad = load
+		}
+	}
+	return best
+}
+
+// loadRatio is in-flight connections per unit of Weight, so a
+// higher-Weight upstream is treated as having spare capacity for
+// proportionally more in-flight connections before least-connections
+// considers it as busy as a lower-Weight peer.
+func loadRatio(u *Upstream) float64 {
+	return float64(u.InFlight()) / float64(u.Weight)
+}
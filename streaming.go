@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isStreamingResponse reports whether resp looks like a streaming
+// response that should reach the client as soon as bytes are available
+// rather than sitting batched in the proxy — the same heuristics
+// httputil.ReverseProxy uses to decide when its FlushInterval applies:
+// SSE content, chunked transfer encoding, or a 200 with no
+// Content-Length at all.
+func isStreamingResponse(resp *HTTPMessage) bool {
+	if ct, ok := resp.Headers.Get("Content-Type"); ok {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(ct)), "text/event-stream") {
+			return true
+		}
+	}
+	if isChunkedEncoding(resp.Headers) {
+		return true
+	}
+	if _, hasCL := resp.Headers.Get("Content-Length"); !hasCL && strings.Contains(resp.StartLine, " 200 ") {
+		return true
+	}
+	return false
+}
+
+// flushWriter wraps a net.Conn in a bufio.Writer and flushes it to the
+// wire either after every Write (flushInterval <= 0) or on a periodic
+// tick driven by a helper goroutine (flushInterval > 0), so streaming
+// responses like SSE or long-polling aren't held back by buffering.
+type flushWriter struct {
+	bw            *bufio.Writer
+	flushInterval time.Duration
+
+	mu     sync.Mutex
+	stopCh chan struct{}
+}
+
+func newFlushWriter(conn net.Conn, flushInterval time.Duration) *flushWriter {
+	fw := &flushWriter{bw: bufio.NewWriter(conn), flushInterval: flushInterval}
+	if flushInterval > 0 {
+		fw.stopCh = make(chan struct{})
+		go fw.periodicFlush()
+	}
+	return fw
+}
+
+func (fw *flushWriter) periodicFlush() {
+	ticker := time.NewTicker(fw.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fw.mu.Lock()
+			fw.bw.Flush()
+			fw.mu.Unlock()
+		case <-fw.stopCh:
+			return
+		}
+	}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.bw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if fw.flushInterval <= 0 {
+		err = fw.bw.Flush()
+	}
+	return n, err
+}
+
+// Close stops the periodic-flush goroutine, if any, and flushes
+// whatever is left buffered.
+func (fw *flushWriter) Close() error {
+	if fw.stopCh != nil {
+		close(fw.stopCh)
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return fw.bw.Flush()
+}
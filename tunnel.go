@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// handleConnectTunnel services an HTTP CONNECT request by dialing the
+// requested host:port directly — bypassing the upstream pool entirely —
+// and then blindly copying bytes in both directions, which is how a
+// forward proxy lets a browser reach HTTPS sites without MITM'ing the
+// TLS handshake. requestLine is the raw "CONNECT host:port HTTP/1.1"
+// line already read off clientReader; clientReader is used (rather than
+// clientConn directly) so any bytes already buffered past the CONNECT
+// headers aren't dropped.
+func handleConnectTunnel(clientConn net.Conn, clientReader *bufio.Reader, requestLine string, allowedPorts map[int]bool) {
+	fields := strings.Fields(requestLine)
+	if len(fields) < 2 {
+		writeSimpleResponse(clientConn, 400, "Bad Request")
+		return
+	}
+	hostPort := fields[1]
+
+	_, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		writeSimpleResponse(clientConn, 400, "Bad Request")
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || !allowedPorts[port] {
+		log.Printf("CONNECT to disallowed port %s rejected", portStr)
+		writeSimpleResponse(clientConn, 403, "Forbidden")
+		return
+	}
+
+	destConn, err := net.Dial("tcp", hostPort)
+	if err != nil {
+		log.Printf("Error dialing CONNECT target %s: %v", hostPort, err)
+		writeSimpleResponse(clientConn, 502, "Bad Gateway")
+		return
+	}
+	defer destConn.Close()
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		log.Printf("Error writing CONNECT response: %v", err)
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(destConn, clientReader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(clientConn, destConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func writeSimpleResponse(conn net.Conn, statusCode int, statusText string) {
+	resp := fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", statusCode, statusText)
+	conn.Write([]byte(resp))
+}